@@ -0,0 +1,302 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jetstream provides a NATS JetStream-backed implementation of the
+// federationapi/storage/tables.FederationQueuePDUs, FederationQueueEDUs and
+// FederationQueueJSON interfaces, as an alternative to the SQL-backed
+// postgres/sqlite3 tables.
+//
+// Every destination server gets its own subject
+// (dendrite.federation.out.<serverName>) within a single shared stream, used
+// purely as a durable append-only log: each queued PDU/EDU is one message,
+// and refIndex (below) mirrors the SQL tables' rows on top of it. Retry and
+// backoff for a failing destination is the caller's responsibility, driven
+// by the same Select-then-send-then-Delete polling loop as the SQL backend
+// — there is no JetStream consumer involved, so there is no redelivery to
+// configure.
+package jetstream
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+)
+
+// outSubject is the per-destination subject that PDUs/EDUs for serverName
+// are published to and consumed from.
+func outSubject(streamName string, serverName gomatrixserverlib.ServerName) string {
+	return fmt.Sprintf("%s.out.%s", streamName, serverName)
+}
+
+// jsonSubject is the subject that transaction JSON blobs are published to.
+// Its messages are the sole source of truth for event content; PDU/EDU
+// queue messages only ever carry a Json-NID header pointing back at one of
+// these.
+func jsonSubject(streamName string) string {
+	return streamName + ".json"
+}
+
+// deleteMessages removes the given stream sequence numbers so that
+// they are no longer delivered to any consumer, mirroring a SQL DELETE.
+func deleteMessages(js nats.JetStreamContext, streamName string, seqs []int64) error {
+	for _, seq := range seqs {
+		if err := js.DeleteMsg(streamName, uint64(seq)); err != nil && err != nats.ErrMsgNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileOrphanedRefs repairs refs after a crash between PublishMsg and
+// refs.put in InsertQueuePDU/InsertQueueEDU: those are two separate writes,
+// so a crash in between leaves a stream message with no refs entry, which
+// pending() would never surface and DeleteQueuePDUs/DeleteQueueEDUs would
+// never remove. It walks every message on streamName's destination subjects,
+// re-deriving (nid, serverName, seq) from each one matched by isOurs and
+// calling refs.put again — put overwrites with the same value it would
+// already hold, so this is safe to run repeatedly, e.g. once at startup.
+func reconcileOrphanedRefs(js nats.JetStreamContext, streamName string, refs *refIndex, isOurs func(header nats.Header) bool) error {
+	info, err := js.StreamInfo(streamName)
+	if err != nil {
+		return err
+	}
+	prefix := streamName + ".out."
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq; seq++ {
+		msg, err := js.GetMsg(streamName, seq)
+		if err == nats.ErrMsgNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(msg.Subject, prefix) || !isOurs(msg.Header) {
+			continue
+		}
+		serverName := gomatrixserverlib.ServerName(strings.TrimPrefix(msg.Subject, prefix))
+		nid, err := strconv.ParseInt(msg.Header.Get("Json-NID"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if err := refs.put(nid, serverName, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refIndex stands in for the (json_nid, server_name) rows of the SQL
+// FederationQueuePDUs/FederationQueueEDUs tables. JetStream messages are
+// immutable and can't carry a mutable "who still wants this" list
+// themselves, so instead we keep one JetStream KV entry per
+// (json NID, destination) pair in two directions:
+//
+//   - byNID, keyed by jsonNID, so SelectDestinationsForPDU/
+//     SelectQueuePDUReferenceJSONCount and their EDU equivalents can answer
+//     "which destinations still reference this JSON" without scanning every
+//     queue message.
+//   - byDest, keyed by destination, so SelectQueuePDUs/SelectQueuePDUCount
+//     and their EDU equivalents can answer "what is still queued for this
+//     destination" as a true peek, without touching JetStream's own
+//     ack/redelivery bookkeeping (Fetch+Nak would otherwise burn into
+//     MaxDeliver on every poll, and ConsumerInfo.NumPending stops counting a
+//     message the moment it has been delivered once).
+//
+// The stored value is always the stream sequence of the destination's queue
+// message, so DeleteQueuePDUs/DeleteQueueEDUs can find and remove exactly
+// that message.
+type refIndex struct {
+	byNID  nats.KeyValue
+	byDest nats.KeyValue
+}
+
+// openRefIndex binds (creating if necessary) the KV buckets used to track
+// references for the given table kind ("pdu" or "edu") within streamName.
+func openRefIndex(js nats.JetStreamContext, streamName, kind string) (*refIndex, error) {
+	byNID, err := openOrCreateKV(js, streamName+"_"+kind+"_refs_by_nid")
+	if err != nil {
+		return nil, err
+	}
+	byDest, err := openOrCreateKV(js, streamName+"_"+kind+"_refs_by_dest")
+	if err != nil {
+		return nil, err
+	}
+	return &refIndex{byNID: byNID, byDest: byDest}, nil
+}
+
+func openOrCreateKV(js nats.JetStreamContext, bucket string) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(bucket)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket})
+	}
+	return kv, err
+}
+
+func byNIDKey(nid int64, serverName gomatrixserverlib.ServerName) string {
+	return fmt.Sprintf("%d.%s", nid, serverName)
+}
+
+// destSeqWidth is the zero-padded width of the sequence number suffix in a
+// byDest key, chosen to fit a uint64 in decimal. The padding keeps a
+// destination's keys sorted in publish order (pending()'s FIFO-ish peek
+// order), and its fixed width lets splitByDestKey recover exactly where the
+// server name ends even when the server name itself contains dots.
+const destSeqWidth = 20
+
+func byDestKey(serverName gomatrixserverlib.ServerName, seq uint64) string {
+	return fmt.Sprintf("%s.%0*d", serverName, destSeqWidth, seq)
+}
+
+// splitByDestKey is the inverse of byDestKey. A plain strings.HasPrefix(key,
+// serverName+".") is not safe here: server names can themselves contain
+// dots, so one destination's name can be a dotted prefix of another's (e.g.
+// "matrix.org" of "matrix.org.uk"), which would leak messages between them.
+// Anchoring on the fixed-width numeric suffix instead means the remainder
+// must match serverName exactly.
+func splitByDestKey(key string) (serverName gomatrixserverlib.ServerName, seq uint64, ok bool) {
+	if len(key) < destSeqWidth+2 {
+		return "", 0, false
+	}
+	sepIdx := len(key) - destSeqWidth - 1
+	if key[sepIdx] != '.' {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(key[sepIdx+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return gomatrixserverlib.ServerName(key[:sepIdx]), seq, true
+}
+
+// put records that serverName's queue message at the given stream sequence
+// references jsonNID.
+func (r *refIndex) put(nid int64, serverName gomatrixserverlib.ServerName, seq uint64) error {
+	if _, err := r.byNID.Put(byNIDKey(nid, serverName), []byte(strconv.FormatUint(seq, 10))); err != nil {
+		return err
+	}
+	_, err := r.byDest.Put(byDestKey(serverName, seq), []byte(strconv.FormatInt(nid, 10)))
+	return err
+}
+
+// take removes and returns the stream sequence previously stored by put for
+// (nid, serverName), if any.
+func (r *refIndex) take(nid int64, serverName gomatrixserverlib.ServerName) (seq uint64, ok bool, err error) {
+	key := byNIDKey(nid, serverName)
+	entry, err := r.byNID.Get(key)
+	if err == nats.ErrKeyNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if seq, err = strconv.ParseUint(string(entry.Value()), 10, 64); err != nil {
+		return 0, false, err
+	}
+	if err = r.byNID.Delete(key); err != nil {
+		return 0, false, err
+	}
+	if err = r.byDest.Delete(byDestKey(serverName, seq)); err != nil {
+		return 0, false, err
+	}
+	return seq, true, nil
+}
+
+// destinations returns every destination that currently has a queue message
+// referencing nid. JetStream KV has no native prefix query, so this walks
+// every key in the bucket; like scanExpired, it's expected to run
+// infrequently (JSON reference-count checks), not on the hot insert/send path.
+func (r *refIndex) destinations(nid int64) ([]gomatrixserverlib.ServerName, error) {
+	keys, err := r.byNID.Keys()
+	if err == nats.ErrNoKeysFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefix := strconv.FormatInt(nid, 10) + "."
+	var dests []gomatrixserverlib.ServerName
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			dests = append(dests, gomatrixserverlib.ServerName(strings.TrimPrefix(key, prefix)))
+		}
+	}
+	return dests, nil
+}
+
+// count returns how many destinations currently reference nid.
+func (r *refIndex) count(nid int64) (int64, error) {
+	dests, err := r.destinations(nid)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(dests)), nil
+}
+
+// pending returns up to limit jsonNIDs still queued for serverName, oldest
+// first, without consuming any of JetStream's ack/redelivery bookkeeping.
+func (r *refIndex) pending(serverName gomatrixserverlib.ServerName, limit int) ([]int64, error) {
+	keys, err := r.byDest.Keys()
+	if err == nats.ErrNoKeysFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var matched []string
+	for _, key := range keys {
+		if dest, _, ok := splitByDestKey(key); ok && dest == serverName {
+			matched = append(matched, key)
+		}
+	}
+	sort.Strings(matched)
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	nids := make([]int64, 0, len(matched))
+	for _, key := range matched {
+		entry, err := r.byDest.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		nid, err := strconv.ParseInt(string(entry.Value()), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		nids = append(nids, nid)
+	}
+	return nids, nil
+}
+
+// pendingCount returns how many queue messages are currently outstanding for
+// serverName.
+func (r *refIndex) pendingCount(serverName gomatrixserverlib.ServerName) (int64, error) {
+	keys, err := r.byDest.Keys()
+	if err == nats.ErrNoKeysFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, key := range keys {
+		if dest, _, ok := splitByDestKey(key); ok && dest == serverName {
+			count++
+		}
+	}
+	return count, nil
+}
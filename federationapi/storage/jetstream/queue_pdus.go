@@ -0,0 +1,112 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jetstream
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/federationapi/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+)
+
+// queuePDUs is the JetStream-backed implementation of tables.FederationQueuePDUs.
+// A message is published per (destination, jsonNID) pair on the
+// destination's subject, carrying the jsonNID in a header; the transaction
+// JSON itself lives in the separate json stream/subject (see queueJSON) and
+// is looked up by jsonNID. refs tracks which destinations still reference a
+// given jsonNID, mirroring the SQL table's rows.
+type queuePDUs struct {
+	js         nats.JetStreamContext
+	streamName string
+	refs       *refIndex
+}
+
+// NewQueuePDUs returns a tables.FederationQueuePDUs backed by JetStream.
+func NewQueuePDUs(js nats.JetStreamContext, streamName string) (tables.FederationQueuePDUs, error) {
+	refs, err := openRefIndex(js, streamName, "pdu")
+	if err != nil {
+		return nil, err
+	}
+	return &queuePDUs{js: js, streamName: streamName, refs: refs}, nil
+}
+
+// ReconcileQueuePDURefs repairs refIndex entries for any PDU queue message
+// that was published but never indexed, e.g. a crash between PublishMsg and
+// refs.put in InsertQueuePDU. Safe to call repeatedly; WireQueues runs it
+// once at startup.
+func ReconcileQueuePDURefs(js nats.JetStreamContext, streamName string) error {
+	refs, err := openRefIndex(js, streamName, "pdu")
+	if err != nil {
+		return err
+	}
+	return reconcileOrphanedRefs(js, streamName, refs, func(header nats.Header) bool {
+		return header.Get("Transaction-ID") != ""
+	})
+}
+
+func (q *queuePDUs) InsertQueuePDU(
+	ctx context.Context, _ *sql.Tx, transactionID string, serverName gomatrixserverlib.ServerName, nid int64,
+) error {
+	msg := nats.NewMsg(outSubject(q.streamName, serverName))
+	msg.Header.Set("Transaction-ID", transactionID)
+	msg.Header.Set("Json-NID", strconv.FormatInt(nid, 10))
+	ack, err := q.js.PublishMsg(msg, nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	return q.refs.put(nid, serverName, ack.Sequence)
+}
+
+func (q *queuePDUs) DeleteQueuePDUs(
+	ctx context.Context, _ *sql.Tx, serverName gomatrixserverlib.ServerName, jsonNIDs []int64,
+) error {
+	for _, nid := range jsonNIDs {
+		seq, ok, err := q.refs.take(nid, serverName)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := q.js.DeleteMsg(q.streamName, seq); err != nil && err != nats.ErrMsgNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *queuePDUs) SelectQueuePDUReferenceJSONCount(ctx context.Context, _ *sql.Tx, jsonNID int64) (int64, error) {
+	return q.refs.count(jsonNID)
+}
+
+func (q *queuePDUs) SelectQueuePDUCount(ctx context.Context, _ *sql.Tx, serverName gomatrixserverlib.ServerName) (int64, error) {
+	return q.refs.pendingCount(serverName)
+}
+
+// SelectQueuePDUs is a non-destructive peek, like the SQL SELECT it
+// replaces: callers poll it repeatedly and only DeleteQueuePDUs actually
+// removes a row. It reads from refs, not a JetStream consumer — see the
+// jetstream package doc for why there is no consumer in this design.
+func (q *queuePDUs) SelectQueuePDUs(ctx context.Context, _ *sql.Tx, serverName gomatrixserverlib.ServerName, limit int) ([]int64, error) {
+	return q.refs.pending(serverName, limit)
+}
+
+func (q *queuePDUs) SelectDestinationsForPDU(ctx context.Context, _ *sql.Tx, jsonNID int64) ([]gomatrixserverlib.ServerName, error) {
+	return q.refs.destinations(jsonNID)
+}
@@ -0,0 +1,85 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jetstream
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/federationapi/storage/shared"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/nats-io/nats.go"
+)
+
+// WireQueues replaces d's FederationQueuePDUs, FederationQueueEDUs and
+// FederationQueueJSON with NATS JetStream-backed implementations, leaving
+// every other table (joined hosts, blacklist, peeks, notary/server signing
+// keys) on whatever SQL backend d was already using. Callers only need this
+// when dbProperties.IsJetStream() is true.
+func WireQueues(d *shared.Database, dbProperties *config.DatabaseOptions) error {
+	opts := dbProperties.JetStream
+	opts.Defaults()
+	if len(opts.Addresses) == 0 {
+		return fmt.Errorf("federationapi: jetstream driver selected but no JetStream addresses configured")
+	}
+
+	// nc is kept open for the lifetime of the process once WireQueues
+	// succeeds, same as the *sql.DB a postgres/sqlite3 backend opens; on any
+	// error below we haven't handed it to anything the caller can clean up,
+	// so we must close it ourselves before returning.
+	nc, err := nats.Connect(strings.Join(opts.Addresses, ","))
+	if err != nil {
+		return err
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:      opts.StreamName,
+		Subjects:  []string{opts.StreamName + ".out.>", jsonSubject(opts.StreamName)},
+		Retention: nats.WorkQueuePolicy,
+	})
+	if err != nil && err != nats.ErrStreamNameAlreadyInUse {
+		nc.Close()
+		return err
+	}
+
+	if err := ReconcileQueuePDURefs(js, opts.StreamName); err != nil {
+		nc.Close()
+		return err
+	}
+	if err := ReconcileQueueEDURefs(js, opts.StreamName); err != nil {
+		nc.Close()
+		return err
+	}
+
+	pdus, err := NewQueuePDUs(js, opts.StreamName)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	edus, err := NewQueueEDUs(js, opts.StreamName)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+	d.FederationQueuePDUs = pdus
+	d.FederationQueueEDUs = edus
+	d.FederationQueueJSON = NewQueueJSON(js, opts.StreamName)
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"github.com/matrix-org/dendrite/federationapi/storage/jetstream"
+	"github.com/matrix-org/dendrite/federationapi/storage/postgres"
+	"github.com/matrix-org/dendrite/federationapi/storage/shared"
+	"github.com/matrix-org/dendrite/federationapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// NewDatabase opens a federationapi database, choosing between postgres and
+// sqlite3 from dbProperties.ConnectionString. If dbProperties.Driver is
+// "jetstream", the federation queue tables (FederationQueuePDUs,
+// FederationQueueEDUs, FederationQueueJSON) are additionally backed by NATS
+// JetStream instead of SQL, so that multiple federation-sender instances can
+// pull from the same outbound backlog with work-queue semantics. Every other
+// table keeps using the SQL backend regardless. Callers of the returned
+// *shared.Database (e.g. FederationInternalAPI) don't need to know which
+// backend is active.
+func NewDatabase(dbProperties *config.DatabaseOptions, cache caching.FederationCache, serverName gomatrixserverlib.ServerName) (*shared.Database, error) {
+	var d *shared.Database
+	if dbProperties.IsPostgres() {
+		db, err := postgres.NewDatabase(dbProperties, cache, serverName)
+		if err != nil {
+			return nil, err
+		}
+		d = &db.Database
+	} else {
+		db, err := sqlite3.NewDatabase(dbProperties, cache, serverName)
+		if err != nil {
+			return nil, err
+		}
+		d = &db.Database
+	}
+	if dbProperties.IsJetStream() {
+		if err := jetstream.WireQueues(d, dbProperties); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// SyncAPI contains the configuration for the sync API component.
+type SyncAPI struct {
+	// Database holds the sync API's own storage: the sync token stream,
+	// invite/peek state, filters, and so on.
+	Database DatabaseOptions `yaml:"database"`
+	// InviteRetention configures the background sweep that compacts retired
+	// rows out of syncapi_invite_events. See InviteRetention for defaults.
+	InviteRetention InviteRetention `yaml:"invite_retention"`
+}
+
+// Defaults sets sane defaults for the sync API, including its invite
+// retention sweep.
+func (c *SyncAPI) Defaults() {
+	c.InviteRetention.Defaults()
+}
+
+// Verify checks that the sync API configuration is internally consistent.
+func (c *SyncAPI) Verify(configErrs *ConfigErrors) {
+	c.Database.Verify(configErrs)
+	c.InviteRetention.Verify(configErrs)
+}
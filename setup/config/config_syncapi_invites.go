@@ -0,0 +1,63 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "time"
+
+// InviteRetention configures background compaction of retired (already
+// rejected/accepted/expired) rows in syncapi_invite_events. It is embedded
+// as SyncAPI.InviteRetention.
+type InviteRetention struct {
+	// Enabled turns on the periodic purge goroutine started alongside the
+	// sync API. Defaults to false so operators opt in explicitly.
+	Enabled bool `yaml:"enabled"`
+	// Period is how often the purge sweep runs. Defaults to 1 hour.
+	Period time.Duration `yaml:"period"`
+	// TTL is how long a retired invite is kept, measured from the moment
+	// it was marked deleted, before it becomes eligible for purging.
+	// Defaults to 72 hours.
+	TTL time.Duration `yaml:"ttl"`
+	// MaxRows caps how many rows a single purge sweep will delete, to avoid
+	// long-running transactions on busy tables. Defaults to 10000.
+	MaxRows int `yaml:"max_rows"`
+}
+
+// Defaults sets the default invite retention configuration. It is disabled
+// by default, as retiring historical invites alters behaviour that
+// previously relied on them being kept forever.
+func (c *InviteRetention) Defaults() {
+	c.Enabled = false
+	c.Period = time.Hour
+	c.TTL = 72 * time.Hour
+	c.MaxRows = 10000
+}
+
+// Verify ensures the invite retention configuration is internally
+// consistent.
+func (c *InviteRetention) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if c.Period <= 0 {
+		configErrs.Add("sync_api.invite_retention.period must be greater than zero")
+	}
+	if c.TTL <= 0 {
+		configErrs.Add("sync_api.invite_retention.ttl must be greater than zero")
+	}
+	if c.MaxRows <= 0 {
+		configErrs.Add("sync_api.invite_retention.max_rows must be greater than zero")
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifier
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// Notifier wakes up /sync requests that are long-polling for new data, and
+// tracks the since-token of every currently connected /sync request via
+// since, for as long as the handler keeps it registered with TrackSince —
+// not just the portion of the request spent blocked inside WaitForEvents.
+//
+// The intended call pattern for a /sync request handler is:
+//
+//	id := n.TrackSince(userID, since)
+//	defer n.StopTracking(id)
+//	if !dataAlreadyAvailable {
+//		n.WaitForEvents(ctx, newData)
+//	}
+//
+// Tracking since before checking whether data is already available (rather
+// than only once the handler decides to block) means OldestSince also
+// accounts for requests that return immediately without ever calling
+// WaitForEvents; those still hold since-token data the client hasn't
+// observed yet until the handler returns.
+type Notifier struct {
+	since *trackSince
+}
+
+// NewNotifier creates a new notifier.
+func NewNotifier() *Notifier {
+	return &Notifier{since: newTrackSince()}
+}
+
+// TrackSince registers a connected /sync request's since-token so that
+// OldestSince accounts for it, and returns a token to pass to StopTracking
+// once the request is done. userID is accepted for parity with the real
+// dendrite notifier's call sites but isn't used as a tracking key, since a
+// single user may have more than one /sync request connected at once.
+func (n *Notifier) TrackSince(userID string, since types.StreamPosition) uint64 {
+	return n.since.startWaiting(since)
+}
+
+// StopTracking stops tracking a request previously registered with
+// TrackSince. Callers should defer this immediately after TrackSince
+// returns, so it runs regardless of how the request ends.
+func (n *Notifier) StopTracking(id uint64) {
+	n.since.stopWaiting(id)
+}
+
+// WaitForEvents blocks the calling /sync request until new data is
+// available, or ctx is cancelled. It does not itself register or
+// unregister anything with OldestSince: the caller must already hold a
+// token from TrackSince for the since this call is blocking on.
+func (n *Notifier) WaitForEvents(ctx context.Context, newData <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+	case <-newData:
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifier
+
+import (
+	"sync"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// trackSince records, for every currently connected /sync request, the
+// since-token it was called with — for the request's whole lifetime, not
+// just while it happens to be blocked inside WaitForEvents. It backs
+// Notifier.OldestSince, which the invite retention purge
+// (syncapi/storage.StartInviteRetentionPurge) uses to make sure it never
+// deletes an invite a connected client might still be about to see: a
+// request that returned immediately because data was already available is
+// just as able to observe that invite as one that blocked for it.
+//
+// Requests are keyed by an opaque per-call token rather than userID: a
+// single user can have more than one /sync connection open at once (e.g.
+// multiple devices), and keying by userID would let the later startWaiting
+// overwrite the earlier one's entry, and either connection's stopWaiting
+// delete both.
+//
+// Notifier.TrackSince/StopTracking are the exported wrappers request
+// handlers call; see Notifier's doc comment for the intended call pattern.
+type trackSince struct {
+	mu      sync.Mutex
+	nextID  uint64
+	waiting map[uint64]types.StreamPosition
+}
+
+func newTrackSince() *trackSince {
+	return &trackSince{waiting: make(map[uint64]types.StreamPosition)}
+}
+
+func (t *trackSince) startWaiting(since types.StreamPosition) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	id := t.nextID
+	t.waiting[id] = since
+	return id
+}
+
+func (t *trackSince) stopWaiting(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.waiting, id)
+}
+
+// oldest returns the lowest since-token any currently-blocked user is
+// waiting on, and false if nobody is currently waiting.
+func (t *trackSince) oldest() (types.StreamPosition, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var (
+		oldest types.StreamPosition
+		found  bool
+	)
+	for _, since := range t.waiting {
+		if !found || since < oldest {
+			oldest = since
+			found = true
+		}
+	}
+	return oldest, found
+}
+
+// OldestSince reports the lowest /sync since-token among all currently
+// connected requests, satisfying syncapi/storage.SinceTracker.
+func (n *Notifier) OldestSince() (types.StreamPosition, bool) {
+	return n.since.oldest()
+}
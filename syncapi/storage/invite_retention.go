@@ -0,0 +1,90 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var inviteEventsPurged = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "invite_events_purged_total",
+		Help:      "Number of retired syncapi_invite_events rows reclaimed by the retention sweep.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(inviteEventsPurged)
+}
+
+// SinceTracker reports the lowest /sync since-token currently held by a
+// connected request, whether or not it happens to be blocked in a
+// long-poll. The retention sweep must never purge an invite above this
+// watermark, since a client connected with that token may still be about
+// to observe it. It is implemented by *syncapi/notifier.Notifier.
+type SinceTracker interface {
+	OldestSince() (types.StreamPosition, bool)
+}
+
+// StartInviteRetentionPurge starts a background goroutine that periodically
+// deletes retired (DeleteInviteEvent already called) rows from
+// syncapi_invite_events, once they fall behind every connected user's
+// /sync since-token and have been retired for at least cfg.TTL. It returns
+// immediately; the goroutine runs until ctx is cancelled.
+func StartInviteRetentionPurge(ctx context.Context, invites tables.Invites, tracker SinceTracker, cfg config.InviteRetention) {
+	if !cfg.Enabled {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.Period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				purgeRetiredInvitesOnce(ctx, invites, tracker, cfg)
+			}
+		}
+	}()
+}
+
+func purgeRetiredInvitesOnce(ctx context.Context, invites tables.Invites, tracker SinceTracker, cfg config.InviteRetention) {
+	watermark, ok := tracker.OldestSince()
+	if !ok {
+		// No connected users right now, so nothing to protect: purge
+		// everything that has aged out.
+		watermark = types.StreamPosition(1<<63 - 1)
+	}
+	reclaimed, err := invites.PurgeRetiredInvites(ctx, watermark, cfg.TTL, cfg.MaxRows)
+	if err != nil {
+		logrus.WithError(err).Error("failed to purge retired syncapi invite events")
+		return
+	}
+	if reclaimed > 0 {
+		inviteEventsPurged.Add(float64(reclaimed))
+		logrus.WithField("rows", reclaimed).Debug("purged retired syncapi invite events")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeInvites records the arguments PurgeRetiredInvites was called with; the
+// other tables.Invites methods are unused by this test.
+type fakeInvites struct {
+	gotOlderThan types.StreamPosition
+	gotTTL       time.Duration
+	gotMaxRows   int
+	toReturn     int64
+}
+
+func (f *fakeInvites) InsertInviteEvent(context.Context, *sql.Tx, *gomatrixserverlib.HeaderedEvent) (types.StreamPosition, error) {
+	return 0, nil
+}
+func (f *fakeInvites) DeleteInviteEvent(context.Context, *sql.Tx, string) (types.StreamPosition, error) {
+	return 0, nil
+}
+func (f *fakeInvites) SelectInviteEventsInRange(context.Context, *sql.Tx, string, types.Range) (map[string]*gomatrixserverlib.HeaderedEvent, map[string]*gomatrixserverlib.HeaderedEvent, error) {
+	return nil, nil, nil
+}
+func (f *fakeInvites) SelectMaxInviteID(context.Context, *sql.Tx) (int64, error) { return 0, nil }
+
+func (f *fakeInvites) PurgeRetiredInvites(ctx context.Context, olderThan types.StreamPosition, ttl time.Duration, maxRows int) (int64, error) {
+	f.gotOlderThan = olderThan
+	f.gotTTL = ttl
+	f.gotMaxRows = maxRows
+	return f.toReturn, nil
+}
+
+// fakeTracker reports a fixed watermark.
+type fakeTracker struct {
+	watermark types.StreamPosition
+	ok        bool
+}
+
+func (f fakeTracker) OldestSince() (types.StreamPosition, bool) { return f.watermark, f.ok }
+
+func TestPurgeRetiredInvitesOnceUsesWatermarkAndConfig(t *testing.T) {
+	invites := &fakeInvites{toReturn: 5}
+	tracker := fakeTracker{watermark: types.StreamPosition(42), ok: true}
+	cfg := config.InviteRetention{
+		Enabled: true,
+		Period:  time.Minute,
+		TTL:     24 * time.Hour,
+		MaxRows: 250,
+	}
+
+	purgeRetiredInvitesOnce(context.Background(), invites, tracker, cfg)
+
+	if invites.gotOlderThan != tracker.watermark {
+		t.Fatalf("olderThan = %d, want the tracker's watermark %d", invites.gotOlderThan, tracker.watermark)
+	}
+	if invites.gotTTL != cfg.TTL {
+		t.Fatalf("ttl = %s, want %s", invites.gotTTL, cfg.TTL)
+	}
+	if invites.gotMaxRows != cfg.MaxRows {
+		t.Fatalf("maxRows = %d, want %d (the configured knob, not a hardcoded constant)", invites.gotMaxRows, cfg.MaxRows)
+	}
+}
+
+func TestPurgeRetiredInvitesOnceNoConnectedUsersPurgesEverything(t *testing.T) {
+	invites := &fakeInvites{toReturn: 1}
+	tracker := fakeTracker{ok: false}
+	cfg := config.InviteRetention{Enabled: true, Period: time.Minute, TTL: time.Hour, MaxRows: 10}
+
+	purgeRetiredInvitesOnce(context.Background(), invites, tracker, cfg)
+
+	if invites.gotOlderThan == 0 {
+		t.Fatalf("olderThan = 0, want a high watermark when nobody is connected so retired rows still get purged")
+	}
+}
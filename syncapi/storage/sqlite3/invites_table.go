@@ -19,6 +19,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -34,11 +35,22 @@ CREATE TABLE IF NOT EXISTS syncapi_invite_events (
 	room_id TEXT NOT NULL,
 	target_user_id TEXT NOT NULL,
 	headered_event_json TEXT NOT NULL,
-	deleted BOOL NOT NULL
+	deleted BOOL NOT NULL,
+	retired_at BIGINT NOT NULL DEFAULT 0
 );
 
 CREATE INDEX IF NOT EXISTS syncapi_invites_target_user_id_idx ON syncapi_invite_events (target_user_id, id);
 CREATE INDEX IF NOT EXISTS syncapi_invites_event_id_idx ON syncapi_invite_events (event_id);
+CREATE INDEX IF NOT EXISTS syncapi_invites_deleted_id_idx ON syncapi_invite_events (deleted, id);
+`
+
+// retired_at is new as of the invite retention feature; existing databases
+// created before this column existed need it added out-of-band, since
+// CREATE TABLE IF NOT EXISTS above is a no-op for them. SQLite has no
+// "ADD COLUMN IF NOT EXISTS", so we just ignore the "duplicate column"
+// failure on databases that already have it.
+const inviteEventsRetiredAtColumnSchema = `
+ALTER TABLE syncapi_invite_events ADD COLUMN retired_at BIGINT NOT NULL DEFAULT 0;
 `
 
 const insertInviteEventSQL = "" +
@@ -47,7 +59,7 @@ const insertInviteEventSQL = "" +
 	" VALUES ($1, $2, $3, $4, $5, false)"
 
 const deleteInviteEventSQL = "" +
-	"UPDATE syncapi_invite_events SET deleted=true, id=$1 WHERE event_id = $2 AND deleted=false"
+	"UPDATE syncapi_invite_events SET deleted=true, id=$1, retired_at=$2 WHERE event_id = $3 AND deleted=false"
 
 const selectInviteEventsInRangeSQL = "" +
 	"SELECT room_id, headered_event_json, deleted FROM syncapi_invite_events" +
@@ -57,24 +69,37 @@ const selectInviteEventsInRangeSQL = "" +
 const selectMaxInviteIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_invite_events"
 
+const purgeRetiredInvitesSQL = "" +
+	"DELETE FROM syncapi_invite_events WHERE id IN (" +
+	"SELECT id FROM syncapi_invite_events" +
+	" WHERE deleted=true AND id < $1 AND retired_at < $2" +
+	" LIMIT $3" +
+	")"
+
 type inviteEventsStatements struct {
 	db                            *sql.DB
+	writer                        sqlutil.Writer
 	streamIDStatements            *streamIDStatements
 	insertInviteEventStmt         *sql.Stmt
 	selectInviteEventsInRangeStmt *sql.Stmt
 	deleteInviteEventStmt         *sql.Stmt
 	selectMaxInviteIDStmt         *sql.Stmt
+	purgeRetiredInvitesStmt       *sql.Stmt
 }
 
-func NewSqliteInvitesTable(db *sql.DB, streamID *streamIDStatements) (tables.Invites, error) {
+func NewSqliteInvitesTable(db *sql.DB, writer sqlutil.Writer, streamID *streamIDStatements) (tables.Invites, error) {
 	s := &inviteEventsStatements{
 		db:                 db,
+		writer:             writer,
 		streamIDStatements: streamID,
 	}
 	_, err := db.Exec(inviteEventsSchema)
 	if err != nil {
 		return nil, err
 	}
+	// Best-effort: the column already exists on databases created with the
+	// schema above, so ignore the "duplicate column name" error here.
+	_, _ = db.Exec(inviteEventsRetiredAtColumnSchema)
 	if s.insertInviteEventStmt, err = db.Prepare(insertInviteEventSQL); err != nil {
 		return nil, err
 	}
@@ -87,6 +112,9 @@ func NewSqliteInvitesTable(db *sql.DB, streamID *streamIDStatements) (tables.Inv
 	if s.selectMaxInviteIDStmt, err = db.Prepare(selectMaxInviteIDSQL); err != nil {
 		return nil, err
 	}
+	if s.purgeRetiredInvitesStmt, err = db.Prepare(purgeRetiredInvitesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -124,7 +152,7 @@ func (s *inviteEventsStatements) DeleteInviteEvent(
 		return streamPos, err
 	}
 	stmt := sqlutil.TxStmt(txn, s.deleteInviteEventStmt)
-	_, err = stmt.ExecContext(ctx, streamPos, inviteEventID)
+	_, err = stmt.ExecContext(ctx, streamPos, time.Now().Unix(), inviteEventID)
 	return streamPos, err
 }
 
@@ -183,3 +211,26 @@ func (s *inviteEventsStatements) SelectMaxInviteID(
 	}
 	return
 }
+
+// PurgeRetiredInvites deletes rows that were already marked deleted=true
+// before olderThan (i.e. no connected /sync long-poll can still see them)
+// and that have been retired for at least ttl, up to maxRows at a time. It
+// runs through the writer like every other write in this file, since
+// sqlite3 only allows a single writer at a time and this can otherwise race
+// with an in-flight /sync InsertInviteEvent/DeleteInviteEvent call.
+func (s *inviteEventsStatements) PurgeRetiredInvites(
+	ctx context.Context, olderThan types.StreamPosition, ttl time.Duration, maxRows int,
+) (int64, error) {
+	retiredBefore := time.Now().Add(-ttl).Unix()
+	var rowsAffected int64
+	err := s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, s.purgeRetiredInvitesStmt)
+		result, err := stmt.ExecContext(ctx, olderThan, retiredBefore, maxRows)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err = result.RowsAffected()
+		return err
+	})
+	return rowsAffected, err
+}
@@ -0,0 +1,41 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tables
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Invites is the interface implemented by the sqlite3 and postgres
+// syncapi_invite_events tables.
+type Invites interface {
+	InsertInviteEvent(ctx context.Context, txn *sql.Tx, inviteEvent *gomatrixserverlib.HeaderedEvent) (streamPos types.StreamPosition, err error)
+	DeleteInviteEvent(ctx context.Context, txn *sql.Tx, inviteEventID string) (types.StreamPosition, error)
+	SelectInviteEventsInRange(ctx context.Context, txn *sql.Tx, targetUserID string, r types.Range) (map[string]*gomatrixserverlib.HeaderedEvent, map[string]*gomatrixserverlib.HeaderedEvent, error)
+	SelectMaxInviteID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// PurgeRetiredInvites deletes invite events that were already retired
+	// (DeleteInviteEvent was called on them) before olderThan, as long as
+	// they are older than ttl. At most maxRows are deleted in one call, so
+	// that a large backlog is reclaimed gradually across several sweeps
+	// rather than in one long-running transaction. It reports how many
+	// rows were reclaimed.
+	PurgeRetiredInvites(ctx context.Context, olderThan types.StreamPosition, ttl time.Duration, maxRows int) (int64, error)
+}
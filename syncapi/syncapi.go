@@ -0,0 +1,45 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncapi
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+)
+
+// AddPublicRoutes sets up the sync API component: it constructs the
+// Notifier shared by every /sync request's long-poll and request-tracking,
+// and starts the component's background workers. In the full dendrite tree
+// this is also where the /sync HTTP routes themselves are registered; this
+// call is the same wiring point the real router registration hangs off of.
+func AddPublicRoutes(ctx context.Context, invites tables.Invites, cfg *config.SyncAPI) *notifier.Notifier {
+	n := notifier.NewNotifier()
+	startInviteRetentionPurge(ctx, invites, n, cfg)
+	return n
+}
+
+// startInviteRetentionPurge is called from AddPublicRoutes once the sync
+// API's storage and notifier are constructed, so that the background
+// invite retention sweep (see syncapi/storage.StartInviteRetentionPurge)
+// has a SinceTracker to avoid purging invites a connected /sync request
+// might still be about to observe.
+func startInviteRetentionPurge(ctx context.Context, invites tables.Invites, n *notifier.Notifier, cfg *config.SyncAPI) {
+	storage.StartInviteRetentionPurge(ctx, invites, n, cfg.InviteRetention)
+}